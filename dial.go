@@ -0,0 +1,156 @@
+package dnsrcache
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// happyEyeballsDelay is how long DialContext waits before starting the IPv4
+// lane, giving IPv6 a head start, per RFC 8305.
+const happyEyeballsDelay = 300 * time.Millisecond
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// DialContext dials addr (host:port) using Fetch, racing an IPv6 lane
+// against an IPv4 lane (Happy-Eyeballs-lite, per RFC 8305): the IPv4 lane
+// starts happyEyeballsDelay after the IPv6 one (skipped if there are no IPv6
+// candidates to race against), and the first successful connection from
+// either lane wins. Within a lane, candidates are tried one at a time in
+// random order, falling through to the next on failure, except that an
+// address which failed on a previous DialContext call for the same host (on
+// any port) is tried last. Assign this as http.Transport.DialContext to get cached, dual-stack
+// dialing.
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := r.Fetch(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no addresses found for host", Addr: host}
+	}
+
+	v6, v4 := splitAndShuffle(ips)
+	r.preferUnfailed(host, v6)
+	r.preferUnfailed(host, v4)
+
+	dialCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var dialer net.Dialer
+	results := make(chan dialResult, 2)
+
+	go func() {
+		conn, err := r.dialLane(dialCtx, &dialer, network, host, port, v6)
+		results <- dialResult{conn: conn, err: err}
+	}()
+	go func() {
+		if len(v6) > 0 {
+			select {
+			case <-time.After(happyEyeballsDelay):
+			case <-dialCtx.Done():
+				results <- dialResult{err: dialCtx.Err()}
+				return
+			}
+		}
+		conn, err := r.dialLane(dialCtx, &dialer, network, host, port, v4)
+		results <- dialResult{conn: conn, err: err}
+	}()
+
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err == nil {
+			if i == 0 {
+				go closeLoser(results, res.conn)
+			}
+			return res.conn, nil
+		}
+		if firstErr == nil {
+			firstErr = res.err
+		}
+	}
+	return nil, firstErr
+}
+
+// dialLane tries each of ips in order until one connects, returning the
+// first success. Addresses that fail are recorded via markDialFailure so the
+// next DialContext call for host tries them last, unless the dial was
+// aborted because the other lane already won.
+func (r *Resolver) dialLane(ctx context.Context, dialer *net.Dialer, network, host, port string, ips []net.IP) (net.Conn, error) {
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, context.Canceled) {
+			r.markDialFailure(host, ip)
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = &net.AddrError{Err: "no addresses in this lane", Addr: host}
+	}
+	return nil, lastErr
+}
+
+// closeLoser waits for the other lane's result, after a winner has already
+// been returned, and closes its connection if it succeeded too, so it isn't
+// leaked.
+func closeLoser(results <-chan dialResult, winner net.Conn) {
+	res := <-results
+	if res.err == nil && res.conn != winner {
+		res.conn.Close()
+	}
+}
+
+// splitAndShuffle partitions ips into IPv6 and IPv4 groups, each in random
+// order, for Happy-Eyeballs-lite dialing.
+func splitAndShuffle(ips []net.IP) (v6, v4 []net.IP) {
+	shuffled := make([]net.IP, len(ips))
+	copy(shuffled, ips)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	for _, ip := range shuffled {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	return v6, v4
+}
+
+func dialFailureKey(host string, ip net.IP) string {
+	return host + "|" + ip.String()
+}
+
+// markDialFailure records that dialing ip for host failed, so the next
+// DialContext call for host tries it last.
+func (r *Resolver) markDialFailure(host string, ip net.IP) {
+	r.dialFailures.Store(dialFailureKey(host, ip), struct{}{})
+}
+
+// preferUnfailed reorders ips in place so that addresses which failed on a
+// previous DialContext call for host sort after ones that haven't, without
+// disturbing the relative (randomized) order within either group.
+func (r *Resolver) preferUnfailed(host string, ips []net.IP) {
+	sort.SliceStable(ips, func(i, j int) bool {
+		_, iFailed := r.dialFailures.Load(dialFailureKey(host, ips[i]))
+		_, jFailed := r.dialFailures.Load(dialFailureKey(host, ips[j]))
+		return !iFailed && jFailed
+	})
+}
@@ -1,36 +1,105 @@
 package dnsrcache
 
 import (
+	"context"
 	"math/rand"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// singleflight key prefixes, one per record family, so a FetchV4 miss never
+// blocks on (or shares the failure of) an in-flight full lookup, and vice
+// versa.
+const (
+	familyAll = "all:"
+	familyV4  = "v4:"
+	familyV6  = "v6:"
 )
 
-// value holds cached IPs and their expiration.
+// LookupFunc resolves host to a set of IPs. Assigning one to
+// Resolver.LookupFunc lets callers plug in a custom *net.Resolver (e.g. one
+// with PreferGo set, or a Dial pointed at a specific upstream) or a fake for
+// tests, instead of the stdlib's net.DefaultResolver.
+type LookupFunc func(ctx context.Context, host string) ([]net.IP, error)
+
+// value holds cached IPs and their expiration. addrs, v4addrs and v6addrs are
+// the same addresses as netip.Addr, kept alongside ips/ipv4s/ipv6s for
+// callers that want the allocation-free, comparable, map-key-friendly netip
+// representation instead. If err is set, this is a negative cache entry: the
+// address fields are nil, and Fetch/FetchV4/FetchAddrs etc. return err
+// instead until it expires.
 type value struct {
 	ips     []net.IP
 	ipv4s   []net.IP
+	ipv6s   []net.IP
+	addrs   []netip.Addr
+	v4addrs []netip.Addr
+	v6addrs []netip.Addr
 	expires time.Time
+	err     error
 }
 
 // Resolver caches DNS lookups.
 type Resolver struct {
 	sync.RWMutex
 	stop       chan struct{}
-	minTTL     time.Duration
 	defaultTTL time.Duration
-	cache      map[string]*value
-	ttls       map[string]time.Duration
+
+	// useRecordTTL, minTTL and maxTTL are set by WithRecordTTL. When enabled,
+	// Lookup caches entries for the authoritative TTL returned by the DNS
+	// server, clamped to [minTTL, maxTTL], instead of defaultTTL.
+	useRecordTTL bool
+	minTTL       time.Duration
+	maxTTL       time.Duration
+	ttlClient    *recordTTLClient
+
+	// LookupFunc, when set, is used instead of net.DefaultResolver to resolve
+	// hostnames. Lookup falls through to the standard resolver when it is nil.
+	LookupFunc LookupFunc
+
+	// PrefetchThreshold, when greater than zero, makes autoRefresh
+	// asynchronously re-resolve an entry once its remaining TTL drops below
+	// this duration, swapping the cached value in place. If the prefetch
+	// fails, the old entry keeps serving until it actually expires.
+	PrefetchThreshold time.Duration
+
+	// OnPrefetch and OnPrefetchError, when set, are called after each
+	// successful or failed autoRefresh resolution (including ones triggered
+	// by PrefetchThreshold), so callers can track refresh activity.
+	OnPrefetch      func(address string)
+	OnPrefetchError func(address string, err error)
+
+	// NegativeTTL controls how long a failed lookup is cached, so a
+	// consistently failing address (e.g. NXDOMAIN) doesn't hit the network on
+	// every Fetch. Defaults to 5 seconds when left at its zero value.
+	NegativeTTL time.Duration
+
+	// CacheErrors decides whether a Lookup failure should be cached as a
+	// negative entry. When nil, only NXDOMAIN-style errors (*net.DNSError
+	// with IsNotFound) are cached; transient errors such as timeouts are
+	// retried on every Fetch instead.
+	CacheErrors func(err error) bool
+
+	stats cacheStats
+	sf    singleflight.Group
+	cache *lruCache[*value]
+	ttls  map[string]time.Duration
+
+	// dialFailures records addresses that failed a previous DialContext
+	// attempt, keyed by dialFailureKey, so the next call tries them last.
+	dialFailures sync.Map
 }
 
 // New creates a new Resolver with the given default TTL.
 func New(defaultTTL time.Duration) *Resolver {
 	resolver := &Resolver{
-		minTTL:     defaultTTL,
 		defaultTTL: defaultTTL,
 		stop:       make(chan struct{}),
-		cache:      make(map[string]*value),
+		cache:      newLRUCache[*value](0),
 		ttls:       make(map[string]time.Duration),
 	}
 	if defaultTTL > 0 {
@@ -39,22 +108,67 @@ func New(defaultTTL time.Duration) *Resolver {
 	return resolver
 }
 
+// WithMaxEntries bounds the cache to at most maxEntries entries, evicting
+// the least recently used entry once the limit is exceeded. A maxEntries of
+// 0 (the default) leaves the cache unbounded. It returns r so it can be
+// chained onto New.
+func (r *Resolver) WithMaxEntries(maxEntries int) *Resolver {
+	r.Lock()
+	r.cache.maxEntries = maxEntries
+	r.Unlock()
+	return r
+}
+
+// Len reports the number of entries currently cached.
+func (r *Resolver) Len() int {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cache.len()
+}
+
+// Stats reports cache hit/miss/eviction/prefetch counters so operators can
+// tune WithMaxEntries and PrefetchThreshold.
+func (r *Resolver) Stats() Stats {
+	return r.stats.snapshot()
+}
+
+// WithRecordTTL switches the Resolver into authoritative mode: Lookup queries
+// the authoritative TTL via github.com/miekg/dns and caches each entry for
+// that TTL instead of defaultTTL, clamped to [minTTL, maxTTL] so pathological
+// values (0, or several days) can't starve or stale the cache. A zero minTTL
+// or maxTTL leaves that side unbounded. It returns r so it can be chained
+// onto New.
+func (r *Resolver) WithRecordTTL(minTTL, maxTTL time.Duration) *Resolver {
+	r.useRecordTTL = true
+	r.minTTL = minTTL
+	r.maxTTL = maxTTL
+	r.ttlClient = newRecordTTLClient()
+	return r
+}
+
 // TTL sets a TTL for a specific address, overwriting the defaultTTL.
 func (r *Resolver) TTL(address string, ttl time.Duration) {
 	r.ttls[address] = ttl
-	if ttl < r.minTTL {
-		r.minTTL = ttl
-	}
 }
 
-// Fetch returns all IPs for the address, using the cache if available.
+// Fetch returns all IPs for the address, using the cache if available. If
+// address is negatively cached (see NegativeTTL), it returns the cached
+// error without touching the network, until that entry expires.
 func (r *Resolver) Fetch(address string) ([]net.IP, error) {
-	r.RLock()
-	value, exists := r.cache[address]
-	r.RUnlock()
+	r.Lock()
+	value, exists := r.cache.get(address)
+	r.Unlock()
 	if exists {
-		return value.ips, nil
+		if value.err == nil {
+			r.stats.recordHit()
+			return value.ips, nil
+		}
+		if time.Now().Before(value.expires) {
+			r.stats.recordHit()
+			return nil, value.err
+		}
 	}
+	r.stats.recordMiss()
 	return r.Lookup(address)
 }
 
@@ -79,21 +193,30 @@ func (r *Resolver) FetchOneString(address string) (string, error) {
 	return ip.String(), nil
 }
 
-// FetchV4 returns all IPv4 addresses for the address.
+// FetchV4 returns all IPv4 addresses for the address. If address is
+// negatively cached (see NegativeTTL), it returns the cached error without
+// touching the network, until that entry expires.
 func (r *Resolver) FetchV4(address string) ([]net.IP, error) {
-	r.RLock()
-	value, exists := r.cache[address]
-	r.RUnlock()
+	r.Lock()
+	value, exists := r.cache.get(address)
+	r.Unlock()
 	if exists {
-		return value.ipv4s, nil
+		if value.err == nil {
+			r.stats.recordHit()
+			return value.ipv4s, nil
+		}
+		if time.Now().Before(value.expires) {
+			r.stats.recordHit()
+			return nil, value.err
+		}
 	}
-	_, err := r.Lookup(address)
-	if err != nil {
+	r.stats.recordMiss()
+	if _, err := r.singleflightLookup(context.Background(), familyV4, address); err != nil {
 		return nil, err
 	}
-	r.RLock()
-	value, exists = r.cache[address]
-	r.RUnlock()
+	r.Lock()
+	value, exists = r.cache.get(address)
+	r.Unlock()
 	if exists {
 		return value.ipv4s, nil
 	}
@@ -121,51 +244,386 @@ func (r *Resolver) FetchOneV4String(address string) (string, error) {
 	return ip.String(), nil
 }
 
-// Refresh reloads expired items. Called automatically by default.
+// FetchV6 returns all IPv6 addresses for the address. If address is
+// negatively cached (see NegativeTTL), it returns the cached error without
+// touching the network, until that entry expires.
+func (r *Resolver) FetchV6(address string) ([]net.IP, error) {
+	r.Lock()
+	value, exists := r.cache.get(address)
+	r.Unlock()
+	if exists {
+		if value.err == nil {
+			r.stats.recordHit()
+			return value.ipv6s, nil
+		}
+		if time.Now().Before(value.expires) {
+			r.stats.recordHit()
+			return nil, value.err
+		}
+	}
+	r.stats.recordMiss()
+	if _, err := r.singleflightLookup(context.Background(), familyV6, address); err != nil {
+		return nil, err
+	}
+	r.Lock()
+	value, exists = r.cache.get(address)
+	r.Unlock()
+	if exists {
+		return value.ipv6s, nil
+	}
+	return nil, nil
+}
+
+// FetchOneV6 returns one IPv6 address for the address.
+func (r *Resolver) FetchOneV6(address string) (net.IP, error) {
+	ips, err := r.FetchV6(address)
+	if err != nil || len(ips) == 0 {
+		return nil, err
+	}
+	if len(ips) == 1 {
+		return ips[0], nil
+	}
+	return ips[rand.Intn(len(ips))], nil
+}
+
+// FetchAddrs returns all addresses for the address as netip.Addr, using the
+// cache if available. It is the netip equivalent of Fetch, for callers that
+// want an allocation-free, comparable, map-key-friendly address instead of
+// net.IP.
+func (r *Resolver) FetchAddrs(address string) ([]netip.Addr, error) {
+	r.Lock()
+	value, exists := r.cache.get(address)
+	r.Unlock()
+	if exists {
+		if value.err == nil {
+			r.stats.recordHit()
+			return value.addrs, nil
+		}
+		if time.Now().Before(value.expires) {
+			r.stats.recordHit()
+			return nil, value.err
+		}
+	}
+	r.stats.recordMiss()
+	if _, err := r.Lookup(address); err != nil {
+		return nil, err
+	}
+	r.Lock()
+	value, exists = r.cache.get(address)
+	r.Unlock()
+	if exists {
+		return value.addrs, nil
+	}
+	return nil, nil
+}
+
+// FetchOneAddr returns one address for the address as a netip.Addr. It is
+// the netip equivalent of FetchOne.
+func (r *Resolver) FetchOneAddr(address string) (netip.Addr, error) {
+	addrs, err := r.FetchAddrs(address)
+	if err != nil || len(addrs) == 0 {
+		return netip.Addr{}, err
+	}
+	if len(addrs) == 1 {
+		return addrs[0], nil
+	}
+	return addrs[rand.Intn(len(addrs))], nil
+}
+
+// FetchV4Addr returns all IPv4 addresses for the address as netip.Addr. It
+// is the netip equivalent of FetchV4.
+func (r *Resolver) FetchV4Addr(address string) ([]netip.Addr, error) {
+	r.Lock()
+	value, exists := r.cache.get(address)
+	r.Unlock()
+	if exists {
+		if value.err == nil {
+			r.stats.recordHit()
+			return value.v4addrs, nil
+		}
+		if time.Now().Before(value.expires) {
+			r.stats.recordHit()
+			return nil, value.err
+		}
+	}
+	r.stats.recordMiss()
+	if _, err := r.singleflightLookup(context.Background(), familyV4, address); err != nil {
+		return nil, err
+	}
+	r.Lock()
+	value, exists = r.cache.get(address)
+	r.Unlock()
+	if exists {
+		return value.v4addrs, nil
+	}
+	return nil, nil
+}
+
+// FetchV6Addr returns all IPv6 addresses for the address as netip.Addr.
+func (r *Resolver) FetchV6Addr(address string) ([]netip.Addr, error) {
+	r.Lock()
+	value, exists := r.cache.get(address)
+	r.Unlock()
+	if exists {
+		if value.err == nil {
+			r.stats.recordHit()
+			return value.v6addrs, nil
+		}
+		if time.Now().Before(value.expires) {
+			r.stats.recordHit()
+			return nil, value.err
+		}
+	}
+	r.stats.recordMiss()
+	if _, err := r.singleflightLookup(context.Background(), familyV6, address); err != nil {
+		return nil, err
+	}
+	r.Lock()
+	value, exists = r.cache.get(address)
+	r.Unlock()
+	if exists {
+		return value.v6addrs, nil
+	}
+	return nil, nil
+}
+
+// FetchAddrPort resolves address and pairs each result with port, as
+// netip.AddrPort, so callers building a dial target don't need a separate
+// net.JoinHostPort/ResolveTCPAddr step. The returned AddrPorts carry no IPv6
+// zone: the cache keeps addresses as net.IP, so the zone of a scoped IPv6
+// address is not kept.
+func (r *Resolver) FetchAddrPort(address string, port uint16) ([]netip.AddrPort, error) {
+	addrs, err := r.FetchAddrs(address)
+	if err != nil {
+		return nil, err
+	}
+	addrPorts := make([]netip.AddrPort, len(addrs))
+	for i, addr := range addrs {
+		addrPorts[i] = netip.AddrPortFrom(addr, port)
+	}
+	return addrPorts, nil
+}
+
+// Refresh reloads expired items, and items whose remaining TTL has dropped
+// below PrefetchThreshold. Called automatically by default.
 func (r *Resolver) Refresh() {
 	now := time.Now()
 	r.RLock()
-	addresses := make([]string, 0, len(r.cache))
-	for key, value := range r.cache {
-		if value.expires.Before(now) {
+	var addresses []string
+	for _, key := range r.cache.keys() {
+		if value, ok := r.cache.peek(key); ok && r.needsRefresh(value, now) {
 			addresses = append(addresses, key)
 		}
 	}
 	r.RUnlock()
 
 	for _, address := range addresses {
-		r.Lookup(address)
+		r.refreshOne(address)
 		time.Sleep(10 * time.Millisecond)
 	}
 }
 
-// Lookup performs a DNS lookup and updates the cache.
+// needsRefresh reports whether value has expired, or is within
+// PrefetchThreshold of expiring.
+func (r *Resolver) needsRefresh(v *value, now time.Time) bool {
+	if v.expires.Before(now) {
+		return true
+	}
+	return r.PrefetchThreshold > 0 && v.expires.Sub(now) <= r.PrefetchThreshold
+}
+
+// refreshOne re-resolves address and reports the outcome via OnPrefetch or
+// OnPrefetchError. On failure an entry that has not yet expired keeps
+// serving, since a failed Lookup never replaces one (see storeNegative).
+func (r *Resolver) refreshOne(address string) {
+	if _, err := r.Lookup(address); err != nil {
+		if r.OnPrefetchError != nil {
+			r.OnPrefetchError(address, err)
+		}
+		return
+	}
+	r.stats.recordPrefetch()
+	if r.OnPrefetch != nil {
+		r.OnPrefetch(address)
+	}
+}
+
+// Lookup performs a DNS lookup and updates the cache. It is equivalent to
+// LookupIPContext with context.Background().
 func (r *Resolver) Lookup(address string) ([]net.IP, error) {
-	ips, err := net.LookupIP(address)
+	return r.LookupIPContext(context.Background(), address)
+}
+
+// LookupIPContext performs a DNS lookup and updates the cache, plumbing ctx
+// into the underlying resolver (or LookupFunc) so callers can cancel it or
+// attach a deadline.
+func (r *Resolver) LookupIPContext(ctx context.Context, address string) ([]net.IP, error) {
+	return r.singleflightLookup(ctx, familyAll, address)
+}
+
+// singleflightLookup collapses concurrent lookups for the same address and
+// family into a single resolution, so Fetch, FetchV4 and Refresh never hit
+// the network twice for the same thing at the same time.
+func (r *Resolver) singleflightLookup(ctx context.Context, family, address string) ([]net.IP, error) {
+	v, err, _ := r.sf.Do(family+address, func() (interface{}, error) {
+		return r.resolve(ctx, address)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]net.IP), nil
+}
+
+// resolve performs the actual DNS lookup via doResolve and, on failure,
+// caches the error per shouldCacheError so repeated Fetch calls for a
+// consistently failing address don't each hit the network.
+func (r *Resolver) resolve(ctx context.Context, address string) ([]net.IP, error) {
+	ips, err := r.doResolve(ctx, address)
 	if err != nil {
+		if r.shouldCacheError(err) {
+			r.storeNegative(address, err)
+		}
 		return nil, err
 	}
+	return ips, nil
+}
+
+// shouldCacheError reports whether err should be cached as a negative entry,
+// per CacheErrors, or defaultCacheErrors if it is unset.
+func (r *Resolver) shouldCacheError(err error) bool {
+	if r.CacheErrors != nil {
+		return r.CacheErrors(err)
+	}
+	return defaultCacheErrors(err)
+}
+
+// storeNegative caches err for address for NegativeTTL (or
+// defaultNegativeTTL if unset), evicting the least recently used entry if
+// the WithMaxEntries limit is exceeded. A successful entry that has not yet
+// expired is left in place, so it keeps serving until it expires.
+func (r *Resolver) storeNegative(address string, err error) {
+	ttl := r.NegativeTTL
+	if ttl <= 0 {
+		ttl = defaultNegativeTTL
+	}
 
+	r.Lock()
+	if cur, ok := r.cache.peek(address); ok && cur.err == nil && time.Now().Before(cur.expires) {
+		r.Unlock()
+		return
+	}
+	_, evicted := r.cache.set(address, &value{
+		err:     err,
+		expires: time.Now().Add(ttl),
+	})
+	r.Unlock()
+	if evicted {
+		r.stats.recordEviction()
+	}
+}
+
+// doResolve performs the actual DNS lookup. It prefers LookupFunc when set,
+// then authoritative record TTL lookups when useRecordTTL is set, and
+// otherwise falls through to net.DefaultResolver.
+func (r *Resolver) doResolve(ctx context.Context, address string) ([]net.IP, error) {
+	if r.LookupFunc != nil {
+		ips, err := r.LookupFunc(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		r.store(address, ips, r.ttlFor(address))
+		return ips, nil
+	}
+
+	if r.useRecordTTL {
+		return r.lookupWithRecordTTL(ctx, address)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	r.store(address, ips, r.ttlFor(address))
+	return ips, nil
+}
+
+// ttlFor returns the configured TTL for address, falling back to
+// defaultTTL.
+func (r *Resolver) ttlFor(address string) time.Duration {
+	if ttl, ok := r.ttls[address]; ok {
+		return ttl
+	}
+	return r.defaultTTL
+}
+
+// lookupWithRecordTTL performs an authoritative DNS lookup and caches the
+// result for the TTL the server returned, clamped to [r.minTTL, r.maxTTL].
+func (r *Resolver) lookupWithRecordTTL(ctx context.Context, address string) ([]net.IP, error) {
+	ips, ttl, err := r.ttlClient.lookupIPTTL(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	r.store(address, ips, clampTTL(ttl, r.minTTL, r.maxTTL))
+	return ips, nil
+}
+
+// store writes ips into the cache for address, expiring after ttl, evicting
+// the least recently used entry if the WithMaxEntries limit is exceeded.
+func (r *Resolver) store(address string, ips []net.IP, ttl time.Duration) {
 	v4s := make([]net.IP, 0, len(ips))
+	v6s := make([]net.IP, 0, len(ips))
 	for _, ip := range ips {
 		if ip.To4() != nil {
 			v4s = append(v4s, ip)
+		} else {
+			v6s = append(v6s, ip)
 		}
 	}
 
-	ttl, ok := r.ttls[address]
-	if !ok {
-		ttl = r.defaultTTL
+	addrs := make([]netip.Addr, 0, len(ips))
+	var v4addrs, v6addrs []netip.Addr
+	for _, ip := range ips {
+		addr, ok := addrFromIP(ip)
+		if !ok {
+			continue
+		}
+		addrs = append(addrs, addr)
+		if addr.Is4() {
+			v4addrs = append(v4addrs, addr)
+		} else {
+			v6addrs = append(v6addrs, addr)
+		}
 	}
-	expires := time.Now().Add(ttl)
+
 	r.Lock()
-	r.cache[address] = &value{
+	_, evicted := r.cache.set(address, &value{
 		ips:     ips,
 		ipv4s:   v4s,
-		expires: expires,
-	}
+		ipv6s:   v6s,
+		addrs:   addrs,
+		v4addrs: v4addrs,
+		v6addrs: v6addrs,
+		expires: time.Now().Add(ttl),
+	})
 	r.Unlock()
-	return ips, nil
+	if evicted {
+		r.stats.recordEviction()
+	}
+}
+
+// addrFromIP converts ip to a netip.Addr, unmapping IPv4-in-IPv6 addresses
+// so an IPv4 address always reports Is4 true regardless of how net.IP
+// represented it.
+func addrFromIP(ip net.IP) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ip.To16())
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
 }
 
 // Stop stops the background refresher. Once stopped, it cannot be started again.
@@ -178,8 +636,36 @@ func (r *Resolver) autoRefresh() {
 		select {
 		case <-r.stop:
 			return
-		case <-time.After(r.minTTL):
+		case <-time.After(r.nextRefresh()):
 			r.Refresh()
 		}
 	}
 }
+
+// nextRefresh returns how long to wait before the next autoRefresh tick: the
+// time remaining until the soonest cache entry is due for refresh (its
+// expiry, minus PrefetchThreshold), or defaultTTL if the cache is currently
+// empty.
+func (r *Resolver) nextRefresh() time.Duration {
+	r.RLock()
+	defer r.RUnlock()
+
+	var soonest time.Time
+	for _, key := range r.cache.keys() {
+		v, ok := r.cache.peek(key)
+		if !ok {
+			continue
+		}
+		due := v.expires.Add(-r.PrefetchThreshold)
+		if soonest.IsZero() || due.Before(soonest) {
+			soonest = due
+		}
+	}
+	if soonest.IsZero() {
+		return r.defaultTTL
+	}
+	if wait := time.Until(soonest); wait > 0 {
+		return wait
+	}
+	return 0
+}
@@ -1,9 +1,13 @@
 package dnsrcache
 
 import (
+	"context"
 	"errors"
 	"net"
+	"net/netip"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -22,6 +26,18 @@ func TestResolver(t *testing.T) {
 		{"FetchOneStringLoadsAValue", testFetchOneStringLoadsAValue},
 		{"FetchLoadsTheIpAndCachesIt", testFetchLoadsTheIpAndCachesIt},
 		{"ItReloadsTheIpsAtAGivenInterval", testItReloadsTheIpsAtAGivenInterval},
+		{"ConcurrentLookupsShareOneResolution", testConcurrentLookupsShareOneResolution},
+		{"LookupFuncOverridesTheStandardResolver", testLookupFuncOverridesTheStandardResolver},
+		{"PrefetchRefreshesBeforeExpiry", testPrefetchRefreshesBeforeExpiry},
+		{"MaxEntriesEvictsTheLeastRecentlyUsed", testMaxEntriesEvictsTheLeastRecentlyUsed},
+		{"NegativeCacheServesTheErrorUntilItExpires", testNegativeCacheServesTheErrorUntilItExpires},
+		{"CacheErrorsControlsWhatGetsNegativelyCached", testCacheErrorsControlsWhatGetsNegativelyCached},
+		{"FetchAddrsReturnsNetipAddrs", testFetchAddrsReturnsNetipAddrs},
+		{"FetchAddrPortPairsEachAddrWithThePort", testFetchAddrPortPairsEachAddrWithThePort},
+		{"FetchV6ReturnsOnlyIPv6Addresses", testFetchV6ReturnsOnlyIPv6Addresses},
+		{"DialContextConnectsToACachedAddress", testDialContextConnectsToACachedAddress},
+		{"DialContextPrefersAnAddressThatDidNotPreviouslyFail", testDialContextPrefersAnAddressThatDidNotPreviouslyFail},
+		{"DialContextFallsBackWithinALaneOnFailure", testDialContextFallsBackWithinALaneOnFailure},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, tt.fn)
@@ -51,27 +67,28 @@ func testFetchv4ReturnsAListOfIps(t *testing.T) {
 func testCallingLookupAddsTheItemToTheCache(t *testing.T) {
 	r := New(0)
 	r.Lookup("go-dnscache.openmymind.io")
-	assertIps(t, r.cache["go-dnscache.openmymind.io"].ips, []string{"8.8.8.8", "8.8.4.4", "2404:6800:4005:8050::1014"})
+	v, _ := r.cache.peek("go-dnscache.openmymind.io")
+	assertIps(t, v.ips, []string{"8.8.8.8", "8.8.4.4", "2404:6800:4005:8050::1014"})
 }
 
 func testFetchLoadsValueFromTheCache(t *testing.T) {
 	r := New(0)
-	r.cache["invalid.openmymind.io"] = &value{
+	r.cache.set("invalid.openmymind.io", &value{
 		ips:     []net.IP{net.ParseIP("1.1.2.3")},
 		ipv4s:   []net.IP{net.ParseIP("1.1.2.3")},
 		expires: time.Now(),
-	}
+	})
 	ips, _ := r.Fetch("invalid.openmymind.io")
 	assertIps(t, ips, []string{"1.1.2.3"})
 }
 
 func testFetchOneLoadsAValue(t *testing.T) {
 	r := New(0)
-	r.cache["something.openmymind.io"] = &value{
+	r.cache.set("something.openmymind.io", &value{
 		ips:     []net.IP{net.ParseIP("1.1.2.3"), net.ParseIP("100.100.102.103")},
 		ipv4s:   []net.IP{net.ParseIP("1.1.2.3"), net.ParseIP("100.100.102.103")},
 		expires: time.Now(),
-	}
+	})
 	ip, _ := r.FetchOne("something.openmymind.io")
 	ipStr := ip.String()
 	if ipStr != "100.100.102.103" && ipStr != "1.1.2.3" {
@@ -81,11 +98,11 @@ func testFetchOneLoadsAValue(t *testing.T) {
 
 func testFetchOneStringLoadsAValue(t *testing.T) {
 	r := New(0)
-	r.cache["something.openmymind.io"] = &value{
+	r.cache.set("something.openmymind.io", &value{
 		ips:     []net.IP{net.ParseIP("100.100.102.103"), net.ParseIP("100.100.102.104")},
 		ipv4s:   []net.IP{net.ParseIP("100.100.102.103"), net.ParseIP("100.100.102.104")},
 		expires: time.Now(),
-	}
+	})
 	ip, _ := r.FetchOneString("something.openmymind.io")
 	if ip != "100.100.102.103" && ip != "100.100.102.104" {
 		t.Errorf("expected ip to be one of two ips, got %s", ip)
@@ -96,14 +113,298 @@ func testFetchLoadsTheIpAndCachesIt(t *testing.T) {
 	r := New(0)
 	ips, _ := r.Fetch("go-dnscache.openmymind.io")
 	assertIps(t, ips, []string{"8.8.4.4", "8.8.8.8", "2404:6800:4005:8050::1014"})
-	assertIps(t, r.cache["go-dnscache.openmymind.io"].ips, []string{"8.8.4.4", "8.8.8.8", "2404:6800:4005:8050::1014"})
+	v, _ := r.cache.peek("go-dnscache.openmymind.io")
+	assertIps(t, v.ips, []string{"8.8.4.4", "8.8.8.8", "2404:6800:4005:8050::1014"})
 }
 
 func testItReloadsTheIpsAtAGivenInterval(t *testing.T) {
 	r := New(time.Nanosecond)
-	r.cache["go-dnscache.openmymind.io"] = &value{expires: time.Now().Add(-time.Minute)}
+	r.cache.set("go-dnscache.openmymind.io", &value{expires: time.Now().Add(-time.Minute)})
+	r.Refresh()
+	v, _ := r.cache.peek("go-dnscache.openmymind.io")
+	assertIps(t, v.ips, []string{"8.8.4.4", "8.8.8.8", "2404:6800:4005:8050::1014"})
+}
+
+func testConcurrentLookupsShareOneResolution(t *testing.T) {
+	r := New(0)
+	var calls int32
+	r.LookupFunc = func(ctx context.Context, host string) ([]net.IP, error) {
+		atomic.AddInt32(&calls, 1)
+		// Hold the resolution open so the other goroutines join it.
+		time.Sleep(100 * time.Millisecond)
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Lookup("shared.invalid")
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected 1 resolution for 10 concurrent lookups, got %d", got)
+	}
+	v, _ := r.cache.peek("shared.invalid")
+	assertIps(t, v.ips, []string{"10.0.0.1"})
+}
+
+func testLookupFuncOverridesTheStandardResolver(t *testing.T) {
+	r := New(0)
+	r.LookupFunc = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+	ips, err := r.Lookup("example.invalid")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	assertIps(t, ips, []string{"10.0.0.1"})
+}
+
+func testPrefetchRefreshesBeforeExpiry(t *testing.T) {
+	r := New(0)
+	r.PrefetchThreshold = time.Hour
+	var prefetched int32
+	r.OnPrefetch = func(address string) {
+		atomic.AddInt32(&prefetched, 1)
+	}
+	r.LookupFunc = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+	r.cache.set("example.invalid", &value{
+		ips:     []net.IP{net.ParseIP("10.0.0.2")},
+		expires: time.Now().Add(time.Minute), // within PrefetchThreshold, not yet expired
+	})
+
 	r.Refresh()
-	assertIps(t, r.cache["go-dnscache.openmymind.io"].ips, []string{"8.8.4.4", "8.8.8.8", "2404:6800:4005:8050::1014"})
+
+	if got := atomic.LoadInt32(&prefetched); got != 1 {
+		t.Fatalf("expected 1 prefetch, got %d", got)
+	}
+	v, _ := r.cache.peek("example.invalid")
+	assertIps(t, v.ips, []string{"10.0.0.1"})
+}
+
+func testMaxEntriesEvictsTheLeastRecentlyUsed(t *testing.T) {
+	r := New(0).WithMaxEntries(2)
+	r.LookupFunc = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+
+	r.Lookup("a.invalid")
+	r.Lookup("b.invalid")
+	r.Lookup("c.invalid")
+
+	if got := r.Len(); got != 2 {
+		t.Fatalf("expected 2 entries, got %d", got)
+	}
+	if _, ok := r.cache.peek("a.invalid"); ok {
+		t.Errorf("expected a.invalid to have been evicted")
+	}
+	if stats := r.Stats(); stats.Evictions != 1 {
+		t.Errorf("expected 1 eviction, got %d", stats.Evictions)
+	}
+}
+
+func testNegativeCacheServesTheErrorUntilItExpires(t *testing.T) {
+	r := New(0)
+	r.NegativeTTL = 50 * time.Millisecond
+	notFound := &net.DNSError{Err: "no such host", Name: "missing.invalid", IsNotFound: true}
+	var calls int32
+	r.LookupFunc = func(ctx context.Context, host string) ([]net.IP, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, notFound
+	}
+
+	if _, err := r.Fetch("missing.invalid"); !errors.Is(err, notFound) {
+		t.Fatalf("expected %v, got %v", notFound, err)
+	}
+	if _, err := r.Fetch("missing.invalid"); !errors.Is(err, notFound) {
+		t.Fatalf("expected cached %v, got %v", notFound, err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected 1 lookup while negatively cached, got %d", got)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := r.Fetch("missing.invalid"); !errors.Is(err, notFound) {
+		t.Fatalf("expected %v after expiry, got %v", notFound, err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("expected a retry after the negative entry expired, got %d calls", got)
+	}
+}
+
+func testCacheErrorsControlsWhatGetsNegativelyCached(t *testing.T) {
+	r := New(0)
+	r.NegativeTTL = time.Hour
+	transient := errors.New("timeout")
+	var calls int32
+	r.LookupFunc = func(ctx context.Context, host string) ([]net.IP, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, transient
+	}
+
+	r.Fetch("flaky.invalid")
+	r.Fetch("flaky.invalid")
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("expected a transient error not to be cached, got %d calls", got)
+	}
+
+	r.CacheErrors = func(err error) bool { return true }
+	r.Fetch("flaky.invalid")
+	r.Fetch("flaky.invalid")
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Fatalf("expected CacheErrors to make the error stick, got %d calls", got)
+	}
+}
+
+func testFetchAddrsReturnsNetipAddrs(t *testing.T) {
+	r := New(0)
+	r.LookupFunc = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}, nil
+	}
+
+	addrs, err := r.FetchAddrs("dual.invalid")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1")}
+	if len(addrs) != len(want) || addrs[0] != want[0] || addrs[1] != want[1] {
+		t.Fatalf("expected %v, got %v", want, addrs)
+	}
+
+	v4, err := r.FetchV4Addr("dual.invalid")
+	if err != nil || len(v4) != 1 || v4[0] != want[0] {
+		t.Fatalf("expected [%v], got %v, err %v", want[0], v4, err)
+	}
+
+	v6, err := r.FetchV6Addr("dual.invalid")
+	if err != nil || len(v6) != 1 || v6[0] != want[1] {
+		t.Fatalf("expected [%v], got %v, err %v", want[1], v6, err)
+	}
+
+	one, err := r.FetchOneAddr("dual.invalid")
+	if err != nil || (one != want[0] && one != want[1]) {
+		t.Fatalf("expected one of %v, got %v, err %v", want, one, err)
+	}
+}
+
+func testFetchAddrPortPairsEachAddrWithThePort(t *testing.T) {
+	r := New(0)
+	r.LookupFunc = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+
+	addrPorts, err := r.FetchAddrPort("single.invalid", 853)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), 853)
+	if len(addrPorts) != 1 || addrPorts[0] != want {
+		t.Fatalf("expected [%v], got %v", want, addrPorts)
+	}
+}
+
+func testFetchV6ReturnsOnlyIPv6Addresses(t *testing.T) {
+	r := New(0)
+	r.LookupFunc = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}, nil
+	}
+
+	ips, err := r.FetchV6("dual.invalid")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	assertIps(t, ips, []string{"2001:db8::1"})
+
+	ip, err := r.FetchOneV6("dual.invalid")
+	if err != nil || ip.String() != "2001:db8::1" {
+		t.Fatalf("expected 2001:db8::1, got %v, err %v", ip, err)
+	}
+}
+
+func testDialContextConnectsToACachedAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to split listener address: %v", err)
+	}
+
+	r := New(0)
+	r.LookupFunc = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("127.0.0.1")}, nil
+	}
+
+	conn, err := r.DialContext(context.Background(), "tcp", net.JoinHostPort("dial.invalid", port))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	conn.Close()
+}
+
+func testDialContextPrefersAnAddressThatDidNotPreviouslyFail(t *testing.T) {
+	r := New(0)
+	good := net.ParseIP("127.0.0.1")
+	bad := net.ParseIP("127.0.0.2")
+	r.markDialFailure("dial.invalid", bad)
+
+	ips := []net.IP{bad, good}
+	r.preferUnfailed("dial.invalid", ips)
+	if !ips[0].Equal(good) || !ips[1].Equal(bad) {
+		t.Fatalf("expected %v before %v, got %v", good, bad, ips)
+	}
+}
+
+func testDialContextFallsBackWithinALaneOnFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to split listener address: %v", err)
+	}
+
+	r := New(0)
+	// 127.0.0.2 has nothing listening on port, so the first dial attempt in
+	// the v4 lane should fail over to 127.0.0.1. Marking 127.0.0.1 as failed
+	// makes it sort last, so 127.0.0.2 is always dialed first.
+	r.LookupFunc = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}, nil
+	}
+	r.markDialFailure("dial.invalid", net.ParseIP("127.0.0.1"))
+
+	conn, err := r.DialContext(context.Background(), "tcp", net.JoinHostPort("dial.invalid", port))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	conn.Close()
 }
 
 func assertIps(t *testing.T, actuals []net.IP, expected []string) {
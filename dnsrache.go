@@ -7,26 +7,83 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
+// ReverseLookupFunc resolves addr to its domain names. Assigning one to
+// DNSReverseCache.LookupFunc lets callers plug in a custom resolver or a
+// fake for tests, instead of net.DefaultResolver.
+type ReverseLookupFunc func(ctx context.Context, addr string) ([]string, error)
+
+// fqdns holds cached domain names and their expiration. If err is set, this
+// is a negative cache entry: domains is nil, and Fetch returns err instead
+// until it expires.
 type fqdns struct {
 	domains []string
 	expires time.Time
+	err     error
 }
 
 // DNSReverseCache is a cache for DNS reverse lookups.
 type DNSReverseCache struct {
 	sync.RWMutex
 	defaultTTL time.Duration
-	cache      map[string]*fqdns
-	cancel     context.CancelFunc
+
+	// useRecordTTL, minTTL and maxTTL are set by WithRecordTTL. When enabled,
+	// LookupAddr caches entries for the authoritative TTL returned by the DNS
+	// server, clamped to [minTTL, maxTTL], instead of defaultTTL.
+	useRecordTTL bool
+	minTTL       time.Duration
+	maxTTL       time.Duration
+	ttlClient    *recordTTLClient
+
+	// LookupFunc, when set, is used instead of net.DefaultResolver to resolve
+	// addresses. LookupAddr falls through to the standard resolver when it is
+	// nil.
+	LookupFunc ReverseLookupFunc
+
+	// PrefetchThreshold, when greater than zero, makes autoRefresh
+	// asynchronously re-resolve an entry once its remaining TTL drops below
+	// this duration, swapping the cached value in place. If the prefetch
+	// fails, the old entry keeps serving until it actually expires.
+	PrefetchThreshold time.Duration
+
+	// OnPrefetch and OnPrefetchError, when set, are called after each
+	// successful or failed autoRefresh resolution (including ones triggered
+	// by PrefetchThreshold), so callers can track refresh activity.
+	OnPrefetch      func(address string)
+	OnPrefetchError func(address string, err error)
+
+	// MaxDomainsPerIP, when greater than zero, truncates a PTR lookup's
+	// result to at most this many names before caching it. OnOversize, if
+	// set, is called with the address and the number of names that were
+	// dropped.
+	MaxDomainsPerIP int
+	OnOversize      func(address string, dropped int)
+
+	// NegativeTTL controls how long a failed lookup is cached, so a
+	// consistently failing address doesn't hit the network on every Fetch.
+	// Defaults to 5 seconds when left at its zero value.
+	NegativeTTL time.Duration
+
+	// CacheErrors decides whether a LookupAddr failure should be cached as a
+	// negative entry. When nil, only NXDOMAIN-style errors (*net.DNSError
+	// with IsNotFound) are cached; transient errors such as timeouts are
+	// retried on every Fetch instead.
+	CacheErrors func(err error) bool
+
+	stats  cacheStats
+	sf     singleflight.Group
+	cache  *lruCache[*fqdns]
+	cancel context.CancelFunc
 }
 
 // NewDNSReverseCache creates a new DNSReverseCache with a default TTL. If TTL <= 0, cache isn't cleared automatically.
 func NewDNSReverseCache(defaultTTL time.Duration) *DNSReverseCache {
 	dcache := &DNSReverseCache{
 		defaultTTL: defaultTTL,
-		cache:      make(map[string]*fqdns),
+		cache:      newLRUCache[*fqdns](0),
 	}
 	if defaultTTL > 0 {
 		ctx, cancel := context.WithCancel(context.Background())
@@ -36,6 +93,44 @@ func NewDNSReverseCache(defaultTTL time.Duration) *DNSReverseCache {
 	return dcache
 }
 
+// WithMaxEntries bounds the cache to at most maxEntries entries, evicting
+// the least recently used entry once the limit is exceeded. A maxEntries of
+// 0 (the default) leaves the cache unbounded. It returns d so it can be
+// chained onto NewDNSReverseCache.
+func (d *DNSReverseCache) WithMaxEntries(maxEntries int) *DNSReverseCache {
+	d.Lock()
+	d.cache.maxEntries = maxEntries
+	d.Unlock()
+	return d
+}
+
+// Len reports the number of entries currently cached.
+func (d *DNSReverseCache) Len() int {
+	d.RLock()
+	defer d.RUnlock()
+	return d.cache.len()
+}
+
+// Stats reports cache hit/miss/eviction/prefetch counters so operators can
+// tune WithMaxEntries and PrefetchThreshold.
+func (d *DNSReverseCache) Stats() Stats {
+	return d.stats.snapshot()
+}
+
+// WithRecordTTL switches the DNSReverseCache into authoritative mode:
+// LookupAddr queries the authoritative TTL via github.com/miekg/dns and
+// caches each entry for that TTL instead of defaultTTL, clamped to [minTTL,
+// maxTTL] so pathological values (0, or several days) can't starve or stale
+// the cache. A zero minTTL or maxTTL leaves that side unbounded. It returns
+// d so it can be chained onto NewDNSReverseCache.
+func (d *DNSReverseCache) WithRecordTTL(minTTL, maxTTL time.Duration) *DNSReverseCache {
+	d.useRecordTTL = true
+	d.minTTL = minTTL
+	d.maxTTL = maxTTL
+	d.ttlClient = newRecordTTLClient()
+	return d
+}
+
 // SetTTL sets a TTL, overwriting the defaultTTL.
 func (d *DNSReverseCache) SetTTL(ttl time.Duration) error {
 	if ttl > 0 {
@@ -45,62 +140,237 @@ func (d *DNSReverseCache) SetTTL(ttl time.Duration) error {
 	return fmt.Errorf("invalid ttl. ttl wasn't set")
 }
 
-// Fetch returns the cached domains for an address or looks them up if expired/missing.
+// Fetch returns the cached domains for an address or looks them up if
+// expired/missing. If address is negatively cached (see NegativeTTL), it
+// returns the cached error without touching the network, until that entry
+// expires.
 func (d *DNSReverseCache) Fetch(address string) ([]string, error) {
-	d.RLock()
-	value, exists := d.cache[address]
-	d.RUnlock()
-	if exists {
-		now := time.Now()
-		if value.expires.After(now) {
-			return value.domains, nil
+	d.Lock()
+	value, exists := d.cache.get(address)
+	d.Unlock()
+	if exists && value.expires.After(time.Now()) {
+		d.stats.recordHit()
+		if value.err != nil {
+			return nil, value.err
 		}
+		return value.domains, nil
 	}
+	d.stats.recordMiss()
 	return d.LookupAddr(context.Background(), address)
 }
 
 // LookupAddr looks up an address, bypassing the cache.
 func (d *DNSReverseCache) LookupAddr(ctx context.Context, address string) ([]string, error) {
+	v, err, _ := d.sf.Do(address, func() (interface{}, error) {
+		return d.resolve(ctx, address)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]string), nil
+}
+
+// resolve performs the actual reverse lookup via doResolve and, on failure,
+// caches the error per shouldCacheError so repeated Fetch calls for a
+// consistently failing address don't each hit the network. Concurrent
+// callers for the same address are collapsed onto this call by LookupAddr's
+// singleflight group.
+func (d *DNSReverseCache) resolve(ctx context.Context, address string) ([]string, error) {
+	results, err := d.doResolve(ctx, address)
+	if err != nil {
+		if d.shouldCacheError(err) {
+			d.storeNegative(address, err)
+		}
+		return nil, err
+	}
+	return results, nil
+}
+
+// shouldCacheError reports whether err should be cached as a negative entry,
+// per CacheErrors, or defaultCacheErrors if it is unset.
+func (d *DNSReverseCache) shouldCacheError(err error) bool {
+	if d.CacheErrors != nil {
+		return d.CacheErrors(err)
+	}
+	return defaultCacheErrors(err)
+}
+
+// storeNegative caches err for address for NegativeTTL (or
+// defaultNegativeTTL if unset), evicting the least recently used entry if
+// the WithMaxEntries limit is exceeded. A successful entry that has not yet
+// expired is left in place, so it keeps serving until it expires.
+func (d *DNSReverseCache) storeNegative(address string, err error) {
+	ttl := d.NegativeTTL
+	if ttl <= 0 {
+		ttl = defaultNegativeTTL
+	}
+
+	d.Lock()
+	if cur, ok := d.cache.peek(address); ok && cur.err == nil && time.Now().Before(cur.expires) {
+		d.Unlock()
+		return
+	}
+	_, evicted := d.cache.set(address, &fqdns{
+		err:     err,
+		expires: time.Now().Add(ttl),
+	})
+	d.Unlock()
+	if evicted {
+		d.stats.recordEviction()
+	}
+}
+
+// doResolve performs the actual reverse lookup. It prefers LookupFunc when
+// set, then authoritative record TTL lookups when useRecordTTL is set, and
+// otherwise falls through to net.DefaultResolver.
+func (d *DNSReverseCache) doResolve(ctx context.Context, address string) ([]string, error) {
+	if d.LookupFunc != nil {
+		results, err := d.LookupFunc(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		return d.store(address, results, d.defaultTTL), nil
+	}
+
+	if d.useRecordTTL {
+		return d.lookupAddrWithRecordTTL(ctx, address)
+	}
+
 	results, err := net.DefaultResolver.LookupAddr(ctx, address)
 	if err != nil {
 		return nil, err
 	}
-	expires := time.Now().Add(d.defaultTTL)
+	return d.store(address, results, d.defaultTTL), nil
+}
+
+// lookupAddrWithRecordTTL performs an authoritative PTR lookup and caches the
+// result for the TTL the server returned, clamped to [d.minTTL, d.maxTTL].
+func (d *DNSReverseCache) lookupAddrWithRecordTTL(ctx context.Context, address string) ([]string, error) {
+	results, ttl, err := d.ttlClient.lookupPTRTTL(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return d.store(address, results, clampTTL(ttl, d.minTTL, d.maxTTL)), nil
+}
+
+// store writes results into the cache for address, expiring after ttl, and
+// returns what was actually stored. If MaxDomainsPerIP is set and results
+// exceeds it, the excess names are dropped and reported via OnOversize
+// rather than stored. The least recently used entry is evicted if the
+// WithMaxEntries limit is exceeded.
+func (d *DNSReverseCache) store(address string, results []string, ttl time.Duration) []string {
+	if d.MaxDomainsPerIP > 0 && len(results) > d.MaxDomainsPerIP {
+		dropped := len(results) - d.MaxDomainsPerIP
+		results = results[:d.MaxDomainsPerIP]
+		if d.OnOversize != nil {
+			d.OnOversize(address, dropped)
+		}
+	}
+
 	d.Lock()
-	d.cache[address] = &fqdns{
+	_, evicted := d.cache.set(address, &fqdns{
 		domains: results,
-		expires: expires,
-	}
+		expires: time.Now().Add(ttl),
+	})
 	d.Unlock()
-	return results, nil
+	if evicted {
+		d.stats.recordEviction()
+	}
+	return results
 }
 
-// Refresh removes expired items from the cache.
+// Refresh removes expired items from the cache, and re-resolves items whose
+// remaining TTL has dropped below PrefetchThreshold.
 func (d *DNSReverseCache) Refresh() {
 	now := time.Now()
-	d.Lock()
-	for key, value := range d.cache {
-		if value.expires.Before(now) {
-			delete(d.cache, key)
+	d.RLock()
+	var expired, prefetch []string
+	for _, key := range d.cache.keys() {
+		value, ok := d.cache.peek(key)
+		if !ok {
+			continue
+		}
+		switch {
+		case value.expires.Before(now):
+			expired = append(expired, key)
+		case d.needsPrefetch(value, now):
+			prefetch = append(prefetch, key)
 		}
 	}
+	d.RUnlock()
+
+	for _, address := range prefetch {
+		d.refreshOne(context.Background(), address)
+	}
+
+	d.Lock()
+	for _, address := range expired {
+		d.cache.delete(address)
+	}
 	d.Unlock()
 }
 
-// autoRefresh periodically calls Refresh at intervals of defaultTTL.
+// needsPrefetch reports whether value is within PrefetchThreshold of
+// expiring.
+func (d *DNSReverseCache) needsPrefetch(v *fqdns, now time.Time) bool {
+	return d.PrefetchThreshold > 0 && v.expires.Sub(now) <= d.PrefetchThreshold
+}
+
+// refreshOne re-resolves address and reports the outcome via OnPrefetch or
+// OnPrefetchError. On failure an entry that has not yet expired keeps
+// serving, since a failed LookupAddr never replaces one (see storeNegative).
+func (d *DNSReverseCache) refreshOne(ctx context.Context, address string) {
+	if _, err := d.LookupAddr(ctx, address); err != nil {
+		if d.OnPrefetchError != nil {
+			d.OnPrefetchError(address, err)
+		}
+		return
+	}
+	d.stats.recordPrefetch()
+	if d.OnPrefetch != nil {
+		d.OnPrefetch(address)
+	}
+}
+
+// autoRefresh wakes up when the soonest cache entry is due for refresh (its
+// expiry, minus PrefetchThreshold) and calls Refresh.
 func (d *DNSReverseCache) autoRefresh(ctx context.Context) {
-	ticker := time.NewTicker(d.defaultTTL)
-	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-time.After(d.nextRefresh()):
 			d.Refresh()
 		}
 	}
 }
 
+// nextRefresh returns how long to wait before the next autoRefresh tick, or
+// defaultTTL if the cache is currently empty.
+func (d *DNSReverseCache) nextRefresh() time.Duration {
+	d.RLock()
+	defer d.RUnlock()
+
+	var soonest time.Time
+	for _, key := range d.cache.keys() {
+		v, ok := d.cache.peek(key)
+		if !ok {
+			continue
+		}
+		due := v.expires.Add(-d.PrefetchThreshold)
+		if soonest.IsZero() || due.Before(soonest) {
+			soonest = due
+		}
+	}
+	if soonest.IsZero() {
+		return d.defaultTTL
+	}
+	if wait := time.Until(soonest); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
 // Close stops the auto-refresh goroutine, if running.
 func (d *DNSReverseCache) Close() {
 	if d.cancel != nil {
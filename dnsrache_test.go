@@ -2,7 +2,10 @@
 package dnsrcache
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"testing"
 	"time"
 )
@@ -59,6 +62,64 @@ func TestDNSReverseCache_AutoRefresh(t *testing.T) {
 	})
 }
 
+func TestMaxDomainsPerIP(t *testing.T) {
+	t.Run("Oversize results are truncated and reported", func(t *testing.T) {
+		cache := NewDNSReverseCache(defaultDuration)
+		cache.MaxDomainsPerIP = 2
+		var droppedFor string
+		var droppedCount int
+		cache.OnOversize = func(address string, dropped int) {
+			droppedFor = address
+			droppedCount = dropped
+		}
+		cache.LookupFunc = func(ctx context.Context, addr string) ([]string, error) {
+			return []string{"a.example.com", "b.example.com", "c.example.com"}, nil
+		}
+
+		hosts, err := cache.Fetch(ExampleAddr)
+		if err != nil {
+			t.Fatalf("Fetch() failed: %v", err)
+		}
+		if len(hosts) != 2 {
+			t.Fatalf("expected 2 hosts, got %d", len(hosts))
+		}
+		if droppedFor != ExampleAddr || droppedCount != 1 {
+			t.Fatalf("expected OnOversize(%q, 1), got (%q, %d)", ExampleAddr, droppedFor, droppedCount)
+		}
+	})
+}
+
+func TestNegativeCache(t *testing.T) {
+	t.Run("Fetch serves the error until the negative entry expires", func(t *testing.T) {
+		cache := NewDNSReverseCache(defaultDuration)
+		cache.NegativeTTL = 50 * time.Millisecond
+		notFound := &net.DNSError{Err: "no such host", Name: ExampleAddr, IsNotFound: true}
+		var calls int
+		cache.LookupFunc = func(ctx context.Context, addr string) ([]string, error) {
+			calls++
+			return nil, notFound
+		}
+
+		if _, err := cache.Fetch(ExampleAddr); !errors.Is(err, notFound) {
+			t.Fatalf("expected %v, got %v", notFound, err)
+		}
+		if _, err := cache.Fetch(ExampleAddr); !errors.Is(err, notFound) {
+			t.Fatalf("expected cached %v, got %v", notFound, err)
+		}
+		if calls != 1 {
+			t.Fatalf("expected 1 lookup while negatively cached, got %d", calls)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		if _, err := cache.Fetch(ExampleAddr); !errors.Is(err, notFound) {
+			t.Fatalf("expected %v after expiry, got %v", notFound, err)
+		}
+		if calls != 2 {
+			t.Fatalf("expected a retry after the negative entry expired, got %d calls", calls)
+		}
+	})
+}
+
 // Example Test
 
 func ExampleDNSReverseCache_Fetch() {
@@ -75,7 +136,7 @@ func ExampleDNSReverseCache_Fetch() {
 	// localhost
 }
 
-func ExampleDNSReverseCache_Fetch_1_1_1_1() {
+func ExampleDNSReverseCache_Fetch_cloudflareDNS() {
 	cache := NewDNSReverseCache(10 * time.Millisecond)
 	hosts, err := cache.Fetch("1.1.1.1")
 	if err != nil {
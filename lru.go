@@ -0,0 +1,125 @@
+package dnsrcache
+
+import (
+	"container/list"
+	"sync/atomic"
+)
+
+// Stats reports cache activity counters, suitable for exporting to a metrics
+// system. It's returned by Resolver.Stats and DNSReverseCache.Stats.
+type Stats struct {
+	Hits       int64
+	Misses     int64
+	Evictions  int64
+	Prefetches int64
+}
+
+// cacheStats holds the atomic counters backing Stats.
+type cacheStats struct {
+	hits       int64
+	misses     int64
+	evictions  int64
+	prefetches int64
+}
+
+func (s *cacheStats) recordHit()      { atomic.AddInt64(&s.hits, 1) }
+func (s *cacheStats) recordMiss()     { atomic.AddInt64(&s.misses, 1) }
+func (s *cacheStats) recordEviction() { atomic.AddInt64(&s.evictions, 1) }
+func (s *cacheStats) recordPrefetch() { atomic.AddInt64(&s.prefetches, 1) }
+
+func (s *cacheStats) snapshot() Stats {
+	return Stats{
+		Hits:       atomic.LoadInt64(&s.hits),
+		Misses:     atomic.LoadInt64(&s.misses),
+		Evictions:  atomic.LoadInt64(&s.evictions),
+		Prefetches: atomic.LoadInt64(&s.prefetches),
+	}
+}
+
+// lruCache is a size-bounded string-keyed store with least-recently-used
+// eviction, backed by container/list for O(1) get/set/delete. A maxEntries
+// of 0 disables eviction, so it behaves like a plain unbounded map.
+type lruCache[V any] struct {
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newLRUCache[V any](maxEntries int) *lruCache[V] {
+	return &lruCache[V]{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// get returns the value for key and marks it as recently used.
+func (c *lruCache[V]) get(key string) (V, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry[V]).value, true
+}
+
+// peek returns the value for key without affecting recency, so background
+// scans (Refresh, nextRefresh) don't perturb eviction order.
+func (c *lruCache[V]) peek(key string) (V, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return el.Value.(*lruEntry[V]).value, true
+}
+
+// set inserts or updates key, evicting the least recently used entry if
+// maxEntries is exceeded. It reports the evicted key, if any.
+func (c *lruCache[V]) set(key string, value V) (evictedKey string, evicted bool) {
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruEntry[V]).value = value
+		c.ll.MoveToFront(el)
+		return "", false
+	}
+
+	el := c.ll.PushFront(&lruEntry[V]{key: key, value: value})
+	c.items[key] = el
+	if c.maxEntries <= 0 || c.ll.Len() <= c.maxEntries {
+		return "", false
+	}
+
+	oldest := c.ll.Back()
+	c.ll.Remove(oldest)
+	ev := oldest.Value.(*lruEntry[V])
+	delete(c.items, ev.key)
+	return ev.key, true
+}
+
+// delete removes key, if present.
+func (c *lruCache[V]) delete(key string) {
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// len reports the number of entries currently cached.
+func (c *lruCache[V]) len() int {
+	return c.ll.Len()
+}
+
+// keys returns every cached key, in no particular order.
+func (c *lruCache[V]) keys() []string {
+	keys := make([]string, 0, c.ll.Len())
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*lruEntry[V]).key)
+	}
+	return keys
+}
@@ -0,0 +1,20 @@
+package dnsrcache
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// defaultNegativeTTL is used by Resolver and DNSReverseCache when
+// NegativeTTL is left at its zero value.
+const defaultNegativeTTL = 5 * time.Second
+
+// defaultCacheErrors reports whether err should be cached as a negative
+// entry: only NXDOMAIN-style errors are, since transient failures (timeouts,
+// server failures) should be retried on the next Fetch rather than sticking
+// around for NegativeTTL.
+func defaultCacheErrors(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
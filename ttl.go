@@ -0,0 +1,128 @@
+package dnsrcache
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recordTTLClient performs authoritative DNS lookups via github.com/miekg/dns
+// so callers can cache entries for the TTL the authoritative server actually
+// returned, instead of a single fixed duration picked up front.
+type recordTTLClient struct {
+	client *dns.Client
+}
+
+func newRecordTTLClient() *recordTTLClient {
+	return &recordTTLClient{client: new(dns.Client)}
+}
+
+// lookupIPTTL resolves the A and AAAA records for host and returns the IPs
+// together with the minimum TTL across every returned record.
+func (c *recordTTLClient) lookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	server, err := c.nameserver()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var minTTL time.Duration
+	haveTTL := false
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(host), qtype)
+		msg.RecursionDesired = true
+
+		resp, _, err := c.client.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			var ip net.IP
+			switch rec := rr.(type) {
+			case *dns.A:
+				ip = rec.A
+			case *dns.AAAA:
+				ip = rec.AAAA
+			default:
+				continue
+			}
+			ips = append(ips, ip)
+			if ttl := time.Duration(rr.Header().Ttl) * time.Second; !haveTTL || ttl < minTTL {
+				minTTL = ttl
+				haveTTL = true
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, minTTL, nil
+}
+
+// lookupPTRTTL resolves the PTR records for addr and returns the domains
+// together with the minimum TTL across every returned record.
+func (c *recordTTLClient) lookupPTRTTL(ctx context.Context, addr string) ([]string, time.Duration, error) {
+	server, err := c.nameserver()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reverse, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(reverse, dns.TypePTR)
+	msg.RecursionDesired = true
+
+	resp, _, err := c.client.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var domains []string
+	var minTTL time.Duration
+	haveTTL := false
+	for _, rr := range resp.Answer {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok {
+			continue
+		}
+		domains = append(domains, ptr.Ptr)
+		if ttl := time.Duration(rr.Header().Ttl) * time.Second; !haveTTL || ttl < minTTL {
+			minTTL = ttl
+			haveTTL = true
+		}
+	}
+	if len(domains) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return domains, minTTL, nil
+}
+
+// nameserver returns the first resolver configured in /etc/resolv.conf.
+func (c *recordTTLClient) nameserver() (string, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(conf.Servers) == 0 {
+		return "", fmt.Errorf("dnsrcache: no nameservers available: %w", err)
+	}
+	return net.JoinHostPort(conf.Servers[0], conf.Port), nil
+}
+
+// clampTTL bounds ttl to [min, max]. A zero min or max leaves that side
+// unbounded.
+func clampTTL(ttl, min, max time.Duration) time.Duration {
+	if min > 0 && ttl < min {
+		return min
+	}
+	if max > 0 && ttl > max {
+		return max
+	}
+	return ttl
+}
@@ -0,0 +1,29 @@
+package dnsrcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClampTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		min      time.Duration
+		max      time.Duration
+		expected time.Duration
+	}{
+		{"WithinBounds", 30 * time.Second, time.Second, time.Hour, 30 * time.Second},
+		{"BelowMinIsRaised", 0, time.Second, time.Hour, time.Second},
+		{"AboveMaxIsLowered", 7 * 24 * time.Hour, time.Second, time.Hour, time.Hour},
+		{"ZeroMinIsUnbounded", 0, 0, time.Hour, 0},
+		{"ZeroMaxIsUnbounded", 7 * 24 * time.Hour, time.Second, 0, 7 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clampTTL(tt.ttl, tt.min, tt.max); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}